@@ -1,28 +1,72 @@
 package influxdb
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	uurl "net/url"
+	"sync"
 	"time"
 
-	"github.com/influxdata/influxdb/client/v2"
 	"github.com/rcrowley/go-metrics"
 )
 
+// Mode selects how counter-like values (Counter, and the count field of
+// Meter/Timer/Histogram) are reported to InfluxDB.
+type Mode int
+
+const (
+	// Cumulative reports the absolute, ever-increasing value, same as
+	// rcrowley/go-metrics exposes it.
+	Cumulative Mode = iota
+	// Delta reports the change since the previous flush, which is what
+	// most InfluxDB dashboards want when graphing rates.
+	Delta
+)
+
+// defaultMaxBatchBacklog is the number of pending flushes the write queue holds before it
+// starts dropping the oldest one to make room, when the caller doesn't set MaxBatchBacklog.
+const defaultMaxBatchBacklog = 8
+
+// defaultMaxRetries bounds how many times the writer goroutine retries a single batch before
+// giving up on it and counting it as dropped.
+const defaultMaxRetries = 5
+
 type reporter struct {
 	reg      metrics.Registry
 	interval time.Duration
 	align    bool
-	url      uurl.URL
-	database string
 
 	measurement string
-	username    string
-	password    string
 	tags        map[string]string
+	mode        Mode
+	legacy      bool
+	maxRetries  int
+
+	cache   map[string]int64
+	batches chan []Point
+	dropped metrics.Counter
+	retries metrics.Counter
 
-	client client.Client
+	// sinkMu guards sink, since run's ping-reconnect branch and writeLoop's writer goroutine
+	// both read/write it concurrently.
+	sinkMu   sync.Mutex
+	sink     Sink
+	makeSink func() (Sink, error)
+}
+
+// getSink returns the current sink, synchronized against run's reconnect branch.
+func (r *reporter) getSink() Sink {
+	r.sinkMu.Lock()
+	defer r.sinkMu.Unlock()
+	return r.sink
+}
+
+// setSink replaces the current sink, synchronized against writeBatch's reads.
+func (r *reporter) setSink(sink Sink) {
+	r.sinkMu.Lock()
+	defer r.sinkMu.Unlock()
+	r.sink = sink
 }
 
 // InfluxDB starts a InfluxDB reporter which will post the metrics from the given registry at each d interval.
@@ -32,129 +76,255 @@ func InfluxDB(r metrics.Registry, d time.Duration, url, database, measurement, u
 
 // InfluxDBWithTags starts a InfluxDB reporter which will post the metrics from the given registry at each d interval with the specified tags
 func InfluxDBWithTags(r metrics.Registry, d time.Duration, url, database, measurement, username, password string, tags map[string]string, align bool) {
-	u, err := uurl.Parse(url)
+	InfluxDBWithTagsAndMode(r, d, url, database, measurement, username, password, tags, align, Cumulative)
+}
+
+// InfluxDBWithTagsAndMode starts a InfluxDB reporter like InfluxDBWithTags but lets the
+// caller pick between Cumulative and Delta reporting for counter-like values.
+func InfluxDBWithTagsAndMode(r metrics.Registry, d time.Duration, url, database, measurement, username, password string, tags map[string]string, align bool, mode Mode) {
+	InfluxDBWithConfigAndLegacy(r, d, url, database, measurement, username, password, tags, align, mode, false)
+}
+
+// InfluxDBWithConfigAndLegacy starts a InfluxDB reporter like InfluxDBWithTagsAndMode but lets
+// the caller opt back into the pre-v0.x point layout, where each Histogram/Meter/Timer field
+// is written as its own point sharing a "bucket" tag, instead of one point per metric with all
+// fields as siblings.
+func InfluxDBWithConfigAndLegacy(r metrics.Registry, d time.Duration, url, database, measurement, username, password string, tags map[string]string, align bool, mode Mode, legacy bool) {
+	InfluxDBWithConfig(Config{
+		Registry:    r,
+		Interval:    d,
+		URL:         url,
+		Database:    database,
+		Measurement: measurement,
+		Username:    username,
+		Password:    password,
+		Tags:        tags,
+		Align:       align,
+		Mode:        mode,
+		Legacy:      legacy,
+	})
+}
+
+// InfluxDBV2 starts an InfluxDB v2 reporter which will post the metrics from the given registry at each d interval.
+func InfluxDBV2(r metrics.Registry, d time.Duration, endpoint, token, organization, bucket, namespace string, align bool) {
+	InfluxDBV2WithTags(r, d, endpoint, token, organization, bucket, namespace, map[string]string{}, align)
+}
+
+// InfluxDBV2WithTags starts an InfluxDB v2 reporter which will post the metrics from the given registry at each d interval with the specified tags.
+func InfluxDBV2WithTags(r metrics.Registry, d time.Duration, endpoint, token, organization, bucket, namespace string, tags map[string]string, align bool) {
+	InfluxDBWithConfig(Config{
+		Registry:    r,
+		Interval:    d,
+		Measurement: namespace,
+		Tags:        tags,
+		Align:       align,
+		Sink:        newV2Sink(endpoint, token, organization, bucket),
+	})
+}
+
+// Config carries every tuning knob InfluxDBWithConfig understands. Zero-value fields fall back
+// to the same defaults the simpler constructors (InfluxDB, InfluxDBWithTags, ...) use.
+type Config struct {
+	Registry    metrics.Registry
+	Interval    time.Duration
+	URL         string
+	Database    string
+	Measurement string
+	Username    string
+	Password    string
+	Tags        map[string]string
+	Align       bool
+	Mode        Mode
+	Legacy      bool
+
+	// Sink, if set, is used to deliver points instead of building one from URL/Database/
+	// Username/Password. This is how InfluxDBV2WithTags plugs in a token-based v2 sink, and
+	// how callers can plug in their own Sink (e.g. WriterSink) for tests.
+	Sink Sink
+
+	// MaxBatchBacklog bounds how many flushes can queue up waiting for the write goroutine
+	// before the oldest one is dropped to make room. Defaults to defaultMaxBatchBacklog.
+	MaxBatchBacklog int
+	// MaxRetries bounds how many times a batch is retried, with exponential backoff capped at
+	// Interval, before it's dropped. Defaults to defaultMaxRetries.
+	MaxRetries int
+}
+
+// InfluxDBWithConfig starts a InfluxDB reporter configured by cfg. Writes go through a bounded
+// queue and a dedicated writer goroutine that retries failed or oversized batches against a
+// Sink instead of dropping them on the first error.
+func InfluxDBWithConfig(cfg Config) {
+	makeSink, err := newSinkFactory(cfg)
 	if err != nil {
-		log.Printf("unable to parse InfluxDB url %s. err=%v", url, err)
+		log.Printf("unable to configure InfluxDB sink. err=%v", err)
 		return
 	}
 
-	rep := &reporter{
-		reg:         r,
-		interval:    d,
-		url:         *u,
-		database:    database,
-		measurement: measurement,
-		username:    username,
-		password:    password,
-		tags:        tags,
-		align:       align,
-	}
-	if err := rep.makeClient(); err != nil {
-		log.Printf("unable to make InfluxDB client. err=%v", err)
+	sink, err := makeSink()
+	if err != nil {
+		log.Printf("unable to make InfluxDB sink. err=%v", err)
 		return
 	}
 
+	maxBatchBacklog := cfg.MaxBatchBacklog
+	if maxBatchBacklog <= 0 {
+		maxBatchBacklog = defaultMaxBatchBacklog
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	rep := &reporter{
+		reg:         cfg.Registry,
+		interval:    cfg.Interval,
+		measurement: cfg.Measurement,
+		tags:        cfg.Tags,
+		align:       cfg.Align,
+		mode:        cfg.Mode,
+		legacy:      cfg.Legacy,
+		maxRetries:  maxRetries,
+		cache:       make(map[string]int64),
+		batches:     make(chan []Point, maxBatchBacklog),
+		dropped:     metrics.GetOrRegisterCounter("influxdb.reporter.dropped", cfg.Registry),
+		retries:     metrics.GetOrRegisterCounter("influxdb.reporter.retries", cfg.Registry),
+		sink:        sink,
+		makeSink:    makeSink,
+	}
+
 	rep.run()
 }
 
-func (r *reporter) makeClient() (err error) {
-	if r.url.Scheme == "http" {
-		r.client, err = client.NewHTTPClient(client.HTTPConfig{
-			Addr:     r.url.String(),
-			Username: r.username,
-			Password: r.password,
-			Timeout:  10 * time.Second,
-		})
-	} else {
-		r.client, err = client.NewUDPClient(client.UDPConfig{
-			Addr:        r.url.Host,
-			PayloadSize: 512,
-		})
+// newSinkFactory returns a function that builds a fresh Sink for cfg, used both for the
+// initial connection and to reconnect after a failed ping. If cfg.Sink is set, that same Sink
+// is reused rather than rebuilt, since callers that plug in their own Sink own its lifecycle.
+func newSinkFactory(cfg Config) (func() (Sink, error), error) {
+	if cfg.Sink != nil {
+		return func() (Sink, error) { return cfg.Sink, nil }, nil
+	}
+
+	u, err := uurl.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse InfluxDB url %s: %w", cfg.URL, err)
 	}
 
-	return
+	return func() (Sink, error) {
+		if u.Scheme == "http" {
+			return newHTTPSink(u.String(), cfg.Username, cfg.Password, cfg.Database)
+		}
+		return newUDPSink(u.Host)
+	}, nil
 }
 
 func (r *reporter) run() {
+	go r.writeLoop()
+
 	intervalTicker := time.Tick(r.interval)
 	pingTicker := time.Tick(time.Second * 5)
 
 	for {
 		select {
 		case <-intervalTicker:
-			if err := r.send(); err != nil {
-				log.Printf("unable to send metrics to InfluxDB. err=%v", err)
-			}
+			r.flush()
 		case <-pingTicker:
-			_, _, err := r.client.Ping(time.Second)
-			if err != nil {
-				log.Printf("got error while sending a ping to InfluxDB, trying to recreate client. err=%v", err)
+			if err := r.getSink().Ping(time.Second); err != nil {
+				log.Printf("got error while sending a ping to InfluxDB, trying to recreate sink. err=%v", err)
 
-				if err = r.makeClient(); err != nil {
-					log.Printf("unable to make InfluxDB client. err=%v", err)
+				if sink, err := r.makeSink(); err != nil {
+					log.Printf("unable to make InfluxDB sink. err=%v", err)
+				} else {
+					r.setSink(sink)
 				}
 			}
 		}
 	}
 }
 
-func (r *reporter) send() error {
-	var pts []*client.Point
+// flush collects the current snapshot of every metric into points and queues them for the
+// writer goroutine. It never blocks on a slow or unreachable InfluxDB: queueing is what
+// applies backpressure, not the flush itself.
+func (r *reporter) flush() {
+	r.enqueue(r.collectPoints())
+}
+
+func (r *reporter) collectPoints() []Point {
+	var pts []Point
 
 	now := time.Now()
 	if r.align {
 		now = now.Truncate(r.interval)
 	}
 	r.reg.Each(func(name string, i interface{}) {
+		// ResettingTimer (from the ethersphere/go-ethereum fork) isn't a type the upstream
+		// rcrowley/go-metrics package declares, so it can't appear as a case in the type switch
+		// below without hard-depending on the fork. Feature-detect it directly off i instead:
+		// if the registry entry happens to expose a Snapshot() returning this shape, treat it as
+		// one, regardless of which go-metrics variant the caller's registry is built against.
+		// Snapshot(), not Values()/Percentiles()/Mean() on i directly, is what drains its sample
+		// every report cycle, same as Counter/Gauge/Histogram/Meter/Timer below.
+		if rt, ok := i.(interface {
+			Snapshot() interface {
+				Values() []int64
+				Percentiles([]float64) []float64
+				Mean() float64
+			}
+		}); ok {
+			ms := rt.Snapshot()
+			values := ms.Values()
+			if len(values) == 0 {
+				return
+			}
+			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
+			fields := map[string]float64{
+				"count":           float64(len(values)),
+				"mean":            ms.Mean(),
+				"50-percentile":   ps[0],
+				"75-percentile":   ps[1],
+				"95-percentile":   ps[2],
+				"99-percentile":   ps[3],
+				"999-percentile":  ps[4],
+				"9999-percentile": ps[5],
+			}
+			pts = append(pts, r.points(fmt.Sprintf("%s.timer", name), fields, now)...)
+			return
+		}
 
 		switch metric := i.(type) {
 		case metrics.Counter:
 			ms := metric.Snapshot()
-			pt, err := client.NewPoint(
-				r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.count", name): ms.Count(),
+			pts = append(pts, Point{
+				Measurement: r.measurement,
+				Tags:        r.tags,
+				Fields: map[string]interface{}{
+					fmt.Sprintf("%s.count", name): r.diff(name, ms.Count()),
 				},
-				now,
-			)
-			if err != nil {
-				return
-			}
-			pts = append(pts, pt)
+				Time: now,
+			})
 		case metrics.Gauge:
 			ms := metric.Snapshot()
-			pt, err := client.NewPoint(
-				r.measurement,
-				r.tags,
-				map[string]interface{}{
+			pts = append(pts, Point{
+				Measurement: r.measurement,
+				Tags:        r.tags,
+				Fields: map[string]interface{}{
 					fmt.Sprintf("%s.gauge", name): ms.Value(),
 				},
-				now,
-			)
-			if err != nil {
-				return
-			}
-			pts = append(pts, pt)
+				Time: now,
+			})
 		case metrics.GaugeFloat64:
 			ms := metric.Snapshot()
-			pt, err := client.NewPoint(
-				r.measurement,
-				r.tags,
-				map[string]interface{}{
+			pts = append(pts, Point{
+				Measurement: r.measurement,
+				Tags:        r.tags,
+				Fields: map[string]interface{}{
 					fmt.Sprintf("%s.gauge", name): ms.Value(),
 				},
-				now,
-			)
-			if err != nil {
-				return
-			}
-			pts = append(pts, pt)
+				Time: now,
+			})
 		case metrics.Histogram:
 			ms := metric.Snapshot()
 			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
 			fields := map[string]float64{
-				"count":    float64(ms.Count()),
+				"count":    float64(r.diff(name, int64(ms.Count()))),
 				"max":      float64(ms.Max()),
 				"mean":     ms.Mean(),
 				"min":      float64(ms.Min()),
@@ -167,49 +337,22 @@ func (r *reporter) send() error {
 				"p999":     ps[4],
 				"p9999":    ps[5],
 			}
-			for k, v := range fields {
-				pt, err := client.NewPoint(
-					r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.histogram", name): v,
-					},
-					now,
-				)
-				if err != nil {
-					continue
-				}
-				pts = append(pts, pt)
-			}
+			pts = append(pts, r.points(fmt.Sprintf("%s.histogram", name), fields, now)...)
 		case metrics.Meter:
 			ms := metric.Snapshot()
 			fields := map[string]float64{
-				"count": float64(ms.Count()),
+				"count": float64(r.diff(name, ms.Count())),
 				"m1":    ms.Rate1(),
 				"m5":    ms.Rate5(),
 				"m15":   ms.Rate15(),
 				"mean":  ms.RateMean(),
 			}
-			for k, v := range fields {
-				pt, err := client.NewPoint(
-					r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.meter", name): v,
-					},
-					now,
-				)
-				if err != nil {
-					continue
-				}
-				pts = append(pts, pt)
-			}
-
+			pts = append(pts, r.points(fmt.Sprintf("%s.meter", name), fields, now)...)
 		case metrics.Timer:
 			ms := metric.Snapshot()
 			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
 			fields := map[string]float64{
-				"count":    float64(ms.Count()),
+				"count":    float64(r.diff(name, int64(ms.Count()))),
 				"max":      float64(ms.Max()),
 				"mean":     ms.Mean(),
 				"min":      float64(ms.Min()),
@@ -226,31 +369,134 @@ func (r *reporter) send() error {
 				"m15":      ms.Rate15(),
 				"meanrate": ms.RateMean(),
 			}
-			for k, v := range fields {
-				pt, err := client.NewPoint(
-					r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.timer", name): v,
-					},
-					now,
-				)
-				if err != nil {
-					continue
-				}
-				pts = append(pts, pt)
-			}
+			pts = append(pts, r.points(fmt.Sprintf("%s.timer", name), fields, now)...)
 		}
 	})
 
-	retryBatch, _ := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  r.database,
-		Precision: "s",
-	})
-	retryBatch.AddPoints(pts)
+	return pts
+}
+
+// enqueue pushes a batch of points onto the bounded write queue. If the queue is full, the
+// oldest pending batch is dropped (and counted) to make room, so a slow or unreachable
+// InfluxDB applies backpressure instead of piling up unbounded memory.
+func (r *reporter) enqueue(pts []Point) {
+	if len(pts) == 0 {
+		return
+	}
+
+	select {
+	case r.batches <- pts:
+		return
+	default:
+	}
+
+	select {
+	case old := <-r.batches:
+		r.dropped.Inc(int64(len(old)))
+	default:
+	}
+
+	select {
+	case r.batches <- pts:
+	default:
+		r.dropped.Inc(int64(len(pts)))
+	}
+}
 
-	err := r.client.Write(retryBatch)
-	return err
+// writeLoop is the sole consumer of the write queue, so retries of one batch never race
+// writes of another.
+func (r *reporter) writeLoop() {
+	for batch := range r.batches {
+		r.writeBatch(batch, 0)
+	}
+}
+
+// writeBatch writes pts to the sink, retrying with exponential backoff (capped at the flush
+// interval) on failure. A partial-write or 413 (request too large) response halves the batch
+// and retries each half independently instead of counting it as a single failed attempt.
+// After maxRetries the batch is dropped and counted via the dropped counter.
+func (r *reporter) writeBatch(pts []Point, attempt int) {
+	if len(pts) == 0 {
+		return
+	}
+
+	if err := r.getSink().Write(pts); err != nil {
+		if len(pts) > 1 && errors.Is(err, ErrBatchTooLarge) {
+			mid := len(pts) / 2
+			r.writeBatch(pts[:mid], attempt)
+			r.writeBatch(pts[mid:], attempt)
+			return
+		}
+
+		if attempt >= r.maxRetries {
+			r.dropped.Inc(int64(len(pts)))
+			log.Printf("dropping %d points after %d failed attempts to write to InfluxDB. err=%v", len(pts), attempt+1, err)
+			return
+		}
+
+		r.retries.Inc(1)
+		backoff := r.retryBackoff(attempt)
+		log.Printf("unable to send metrics to InfluxDB, retrying in %s (retry %d/%d). err=%v", backoff, attempt+1, r.maxRetries, err)
+		time.Sleep(backoff)
+		r.writeBatch(pts, attempt+1)
+	}
+}
+
+// retryBackoff doubles with each attempt, capped at the flush interval so a struggling
+// InfluxDB never causes retries to fall further and further behind the reporting cadence.
+func (r *reporter) retryBackoff(attempt int) time.Duration {
+	backoff := time.Second << uint(attempt)
+	if backoff <= 0 || backoff > r.interval {
+		return r.interval
+	}
+	return backoff
+}
+
+// diff returns current unchanged in Cumulative mode. In Delta mode it returns
+// the change since the previous call for the same name (which may be
+// negative, e.g. after a Counter.Dec or reset) and updates the cache.
+func (r *reporter) diff(name string, current int64) int64 {
+	if r.mode != Delta {
+		return current
+	}
+
+	prev := r.cache[name]
+	r.cache[name] = current
+	return current - prev
+}
+
+// points turns a multi-field metric (Histogram/Meter/Timer) into one or more Points.
+// In legacy mode it reproduces the old layout: one point per field, sharing measurement
+// and a "bucket" tag naming the field, with the value under fieldKey (e.g. "foo.timer").
+// Otherwise it emits a single point at a measurement named after the metric, with every
+// field as a sibling (e.g. SELECT "p99" FROM "foo.timer"), avoiding the series-cardinality
+// blowup of tagging each bucket separately.
+func (r *reporter) points(fieldKey string, fields map[string]float64, now time.Time) []Point {
+	if r.legacy {
+		pts := make([]Point, 0, len(fields))
+		for k, v := range fields {
+			pts = append(pts, Point{
+				Measurement: r.measurement,
+				Tags:        bucketTags(k, r.tags),
+				Fields: map[string]interface{}{
+					fieldKey: v,
+				},
+				Time: now,
+			})
+		}
+		return pts
+	}
+
+	values := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		values[k] = v
+	}
+	return []Point{{
+		Measurement: fieldKey,
+		Tags:        r.tags,
+		Fields:      values,
+		Time:        now,
+	}}
 }
 
 func bucketTags(bucket string, tags map[string]string) map[string]string {
@@ -0,0 +1,222 @@
+package influxdb
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestReporterDiffCumulativeReturnsAbsoluteValue(t *testing.T) {
+	r := &reporter{mode: Cumulative, cache: make(map[string]int64)}
+
+	if got := r.diff("x", 10); got != 10 {
+		t.Fatalf("diff(10) = %d, want 10", got)
+	}
+	if got := r.diff("x", 25); got != 25 {
+		t.Fatalf("diff(25) = %d, want 25", got)
+	}
+}
+
+func TestReporterDiffDeltaReturnsChangeSincePreviousFlush(t *testing.T) {
+	r := &reporter{mode: Delta, cache: make(map[string]int64)}
+
+	if got := r.diff("x", 10); got != 10 {
+		t.Fatalf("first diff = %d, want 10 (nothing cached yet)", got)
+	}
+	if got := r.diff("x", 25); got != 15 {
+		t.Fatalf("second diff = %d, want 15", got)
+	}
+	// Counter.Dec, or a process restart resetting the underlying counter, should produce a
+	// negative delta rather than clamping at zero or panicking.
+	if got := r.diff("x", 5); got != -20 {
+		t.Fatalf("diff after decrease = %d, want -20", got)
+	}
+}
+
+func TestReporterDiffTracksEachMetricIndependently(t *testing.T) {
+	r := &reporter{mode: Delta, cache: make(map[string]int64)}
+
+	r.diff("a", 100)
+	r.diff("b", 5)
+
+	if got := r.diff("a", 130); got != 30 {
+		t.Fatalf("diff for a = %d, want 30", got)
+	}
+	if got := r.diff("b", 8); got != 3 {
+		t.Fatalf("diff for b = %d, want 3", got)
+	}
+}
+
+func TestReporterPointsNonLegacy(t *testing.T) {
+	r := &reporter{tags: map[string]string{"host": "a"}}
+	fields := map[string]float64{"count": 1, "p99": 2.5}
+
+	pts := r.points("foo.timer", fields, time.Time{})
+
+	if len(pts) != 1 {
+		t.Fatalf("expected a single multi-field point, got %d", len(pts))
+	}
+	pt := pts[0]
+	if pt.Measurement != "foo.timer" {
+		t.Fatalf("measurement = %q, want %q", pt.Measurement, "foo.timer")
+	}
+	if len(pt.Fields) != len(fields) {
+		t.Fatalf("fields = %v, want %v", pt.Fields, fields)
+	}
+	if pt.Tags["host"] != "a" {
+		t.Fatalf("tags not propagated: %v", pt.Tags)
+	}
+}
+
+func TestReporterPointsLegacy(t *testing.T) {
+	r := &reporter{legacy: true, measurement: "metrics", tags: map[string]string{"host": "a"}}
+	fields := map[string]float64{"count": 1, "p99": 2.5}
+
+	pts := r.points("foo.timer", fields, time.Time{})
+
+	if len(pts) != len(fields) {
+		t.Fatalf("expected one point per field, got %d", len(pts))
+	}
+	seen := map[string]bool{}
+	for _, pt := range pts {
+		if pt.Measurement != "metrics" {
+			t.Fatalf("measurement = %q, want %q", pt.Measurement, "metrics")
+		}
+		bucket := pt.Tags["bucket"]
+		seen[bucket] = true
+		if v, ok := pt.Fields["foo.timer"]; !ok || v != fields[bucket] {
+			t.Fatalf("field %q = %v, want %v", "foo.timer", v, fields[bucket])
+		}
+		if pt.Tags["host"] != "a" {
+			t.Fatalf("tags not propagated: %v", pt.Tags)
+		}
+	}
+	for k := range fields {
+		if !seen[k] {
+			t.Fatalf("missing bucket %q", k)
+		}
+	}
+}
+
+func TestCollectPointsThroughWriterSink(t *testing.T) {
+	reg := metrics.NewRegistry()
+	timer := metrics.NewTimer()
+	reg.Register("foo", timer)
+	timer.Update(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	r := &reporter{
+		reg:   reg,
+		tags:  map[string]string{},
+		mode:  Cumulative,
+		cache: make(map[string]int64),
+		sink:  NewWriterSink(&buf),
+	}
+	r.writeBatch(r.collectPoints(), 0)
+
+	out := buf.String()
+	if !strings.Contains(out, "foo.timer") {
+		t.Fatalf("expected output to mention measurement foo.timer, got %q", out)
+	}
+}
+
+// fakeSink is a Sink double for exercising writeBatch's retry/backoff and batch-halving
+// behavior without a live InfluxDB. failures counts down on each Write call, returning err
+// until it hits zero; maxBatchSize, if set, makes Write return ErrBatchTooLarge for any batch
+// larger than it, regardless of failures.
+type fakeSink struct {
+	failures     int
+	err          error
+	maxBatchSize int
+	calls        int
+	writes       [][]Point
+}
+
+func (s *fakeSink) Write(pts []Point) error {
+	s.calls++
+	if s.maxBatchSize > 0 && len(pts) > s.maxBatchSize {
+		return ErrBatchTooLarge
+	}
+	if s.failures > 0 {
+		s.failures--
+		return s.err
+	}
+	s.writes = append(s.writes, pts)
+	return nil
+}
+
+func (s *fakeSink) Ping(time.Duration) error { return nil }
+
+func (s *fakeSink) Close() error { return nil }
+
+func TestWriteBatchRetriesThenSucceeds(t *testing.T) {
+	sink := &fakeSink{failures: 2, err: errors.New("connection refused")}
+	r := &reporter{
+		interval:   time.Millisecond,
+		maxRetries: 5,
+		sink:       sink,
+		retries:    metrics.NewCounter(),
+		dropped:    metrics.NewCounter(),
+	}
+	pts := []Point{{Measurement: "m", Fields: map[string]interface{}{"v": 1}}}
+
+	r.writeBatch(pts, 0)
+
+	if sink.calls != 3 {
+		t.Fatalf("calls = %d, want 3 (2 failures + 1 success)", sink.calls)
+	}
+	if got := r.retries.Count(); got != 2 {
+		t.Fatalf("retries = %d, want 2", got)
+	}
+	if len(sink.writes) != 1 || len(sink.writes[0]) != 1 {
+		t.Fatalf("expected the batch to be written whole once it succeeded, got %v", sink.writes)
+	}
+}
+
+func TestWriteBatchDropsAfterMaxRetries(t *testing.T) {
+	sink := &fakeSink{failures: 100, err: errors.New("boom")}
+	r := &reporter{
+		interval:   time.Millisecond,
+		maxRetries: 2,
+		sink:       sink,
+		retries:    metrics.NewCounter(),
+		dropped:    metrics.NewCounter(),
+	}
+	pts := []Point{{Measurement: "m"}, {Measurement: "m"}}
+
+	r.writeBatch(pts, 0)
+
+	if got := r.dropped.Count(); got != int64(len(pts)) {
+		t.Fatalf("dropped = %d, want %d", got, len(pts))
+	}
+}
+
+func TestWriteBatchHalvesOversizedBatch(t *testing.T) {
+	sink := &fakeSink{maxBatchSize: 1}
+	r := &reporter{
+		interval:   time.Millisecond,
+		maxRetries: 5,
+		sink:       sink,
+		retries:    metrics.NewCounter(),
+		dropped:    metrics.NewCounter(),
+	}
+	pts := []Point{{Measurement: "a"}, {Measurement: "b"}, {Measurement: "c"}, {Measurement: "d"}}
+
+	r.writeBatch(pts, 0)
+
+	if len(sink.writes) != len(pts) {
+		t.Fatalf("expected the batch to be halved down to %d single-point writes, got %d", len(pts), len(sink.writes))
+	}
+	for _, w := range sink.writes {
+		if len(w) != 1 {
+			t.Fatalf("expected every write to be a single point after halving, got %d", len(w))
+		}
+	}
+	if r.dropped.Count() != 0 {
+		t.Fatalf("dropped = %d, want 0", r.dropped.Count())
+	}
+}
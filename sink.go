@@ -0,0 +1,224 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// ErrBatchTooLarge is wrapped into the error a Sink's Write returns when it can tell InfluxDB
+// rejected the write for being too large (a partial write, or a 413 Request Entity Too Large).
+// writeBatch checks for it with errors.Is to decide whether to halve the batch and retry each
+// half, instead of just backing off and retrying the whole thing.
+//
+// Only httpSink and udpSink detect and wrap this today, since it's based on v1 client/v2's
+// known error text. v2Sink and WriterSink don't yet distinguish oversized-batch errors from any
+// other write failure, so a too-large write against those sinks falls back to plain retries
+// with backoff rather than being halved.
+var ErrBatchTooLarge = errors.New("influxdb: batch too large")
+
+// isV1OversizedWrite reports whether err looks like InfluxDB's v1 HTTP API rejected the write
+// for being too large, either a partial write (some points accepted, write still errors) or a
+// 413 Request Entity Too Large. Neither is exposed as a typed error by client/v2, so we match
+// on the message text it's known to return.
+func isV1OversizedWrite(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "partial write") ||
+		strings.Contains(msg, "413") ||
+		strings.Contains(msg, "Request Entity Too Large")
+}
+
+// Point is a backend-agnostic measurement: a name, its tags, its fields, and a timestamp. It
+// mirrors the shape every InfluxDB wire protocol actually writes, without tying reporter to
+// any one client library.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// Sink is anywhere a reporter can deliver points: a live InfluxDB (v1 or v2, HTTP or UDP), or
+// anything else that can accept line-protocol-shaped data, such as WriterSink. Implementing
+// Sink lets callers unit-test their integration without a live InfluxDB, or forward metrics
+// through something other than InfluxDB's own client.
+type Sink interface {
+	Write(points []Point) error
+	Ping(timeout time.Duration) error
+	Close() error
+}
+
+// httpSink writes via InfluxDB's v1 HTTP client.
+type httpSink struct {
+	client   client.Client
+	database string
+}
+
+func newHTTPSink(addr, username, password, database string) (Sink, error) {
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+		Timeout:  10 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &httpSink{client: c, database: database}, nil
+}
+
+func (s *httpSink) Write(points []Point) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  s.database,
+		Precision: "s",
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		pt, err := client.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			continue
+		}
+		bp.AddPoint(pt)
+	}
+	if err := s.client.Write(bp); err != nil {
+		if isV1OversizedWrite(err) {
+			return fmt.Errorf("%w: %v", ErrBatchTooLarge, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *httpSink) Ping(timeout time.Duration) error {
+	_, _, err := s.client.Ping(timeout)
+	return err
+}
+
+func (s *httpSink) Close() error {
+	return s.client.Close()
+}
+
+// udpSink writes via InfluxDB's v1 UDP client. InfluxDB doesn't acknowledge UDP writes, so
+// Ping is a no-op success and Write errors only reflect local socket failures.
+type udpSink struct {
+	client client.Client
+}
+
+func newUDPSink(addr string) (Sink, error) {
+	c, err := client.NewUDPClient(client.UDPConfig{
+		Addr:        addr,
+		PayloadSize: 512,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &udpSink{client: c}, nil
+}
+
+func (s *udpSink) Write(points []Point) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{Precision: "s"})
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		pt, err := client.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			continue
+		}
+		bp.AddPoint(pt)
+	}
+	if err := s.client.Write(bp); err != nil {
+		if isV1OversizedWrite(err) {
+			return fmt.Errorf("%w: %v", ErrBatchTooLarge, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *udpSink) Ping(timeout time.Duration) error {
+	_, _, err := s.client.Ping(timeout)
+	return err
+}
+
+func (s *udpSink) Close() error {
+	return s.client.Close()
+}
+
+// v2Sink writes via InfluxDB v2's token-based HTTP API.
+//
+// It uses WriteAPIBlocking rather than the async WriteAPI and its Errors() channel: reporter
+// already does its own batching, retry, and backoff around Sink.Write (see writeBatch), and a
+// blocking write gives writeBatch a synchronous error it can retry on, same as the v1 HTTP/UDP
+// sinks.
+type v2Sink struct {
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+}
+
+func newV2Sink(endpoint, token, organization, bucket string) Sink {
+	c := influxdb2.NewClient(endpoint, token)
+	return &v2Sink{
+		client:   c,
+		writeAPI: c.WriteAPIBlocking(organization, bucket),
+	}
+}
+
+func (s *v2Sink) Write(points []Point) error {
+	pts := make([]*write.Point, 0, len(points))
+	for _, p := range points {
+		pts = append(pts, write.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time))
+	}
+	return s.writeAPI.WritePoint(context.Background(), pts...)
+}
+
+func (s *v2Sink) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := s.client.Ping(ctx)
+	return err
+}
+
+func (s *v2Sink) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// WriterSink serializes points as InfluxDB line protocol to an io.Writer instead of writing to
+// a live server. Useful for unit tests, stdout debugging, or shipping through Telegraf's
+// socket listener.
+type WriterSink struct {
+	w io.Writer
+}
+
+// NewWriterSink returns a Sink that writes line protocol to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(points []Point) error {
+	for _, p := range points {
+		pt, err := client.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			continue
+		}
+		if _, err := io.WriteString(s.w, pt.String()+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WriterSink) Ping(time.Duration) error { return nil }
+
+func (s *WriterSink) Close() error { return nil }